@@ -0,0 +1,191 @@
+// Package identity implements the SQRL Identity Lock / rescue-code
+// operations used to recover an account when a client's Identity
+// Master Key is lost or a new one needs to be issued.
+//
+// A client's Identity Unlock Key (IUK) is sealed with a key derived
+// from the user's 24-digit rescue code via Argon2id, so the IUK can
+// be recovered later to authorize rekeying without the SP ever
+// storing or seeing the rescue code itself.
+package identity
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"errors"
+	"io"
+
+	"golang.org/x/crypto/argon2"
+)
+
+// RescueCodeLength is the number of digits in a SQRL rescue code.
+const RescueCodeLength = 24
+
+// ErrInvalidRescueCode is returned when a rescue code does not unlock
+// a given SealedIUK, either because it's wrong or the blob has been
+// tampered with; Argon2id and AES-GCM make the two indistinguishable.
+var ErrInvalidRescueCode = errors.New("identity: rescue code does not unlock this identity")
+
+// ErrMalformedRescueCode is returned when a rescue code isn't 24
+// digits, so callers can tell a typo from a wrong-but-valid-looking
+// code.
+var ErrMalformedRescueCode = errors.New("identity: rescue code must be 24 digits")
+
+// Argon2Params records the Argon2id cost parameters a SealedIUK was
+// derived with. Storing them alongside the blob lets the parameters
+// be strengthened over time (e.g. as hardware gets faster) without
+// invalidating identities sealed under older, weaker settings.
+type Argon2Params struct {
+	Time      uint32
+	MemoryKiB uint32
+	Threads   uint8
+	KeyLen    uint32
+}
+
+// DefaultArgon2Params are the parameters used to seal new IUKs. They
+// follow the OWASP-recommended floor for Argon2id: a 64 MiB memory
+// cost makes GPU/ASIC cracking impractical while remaining a sub-
+// second operation on commodity server hardware.
+var DefaultArgon2Params = Argon2Params{
+	Time:      3,
+	MemoryKiB: 64 * 1024,
+	Threads:   4,
+	KeyLen:    32,
+}
+
+// SealedIUK is a client's Identity Unlock Key, encrypted under a key
+// derived from the account's rescue code. It is the only durable
+// copy of the IUK the SP ever holds, and should be persisted
+// alongside the account it belongs to.
+type SealedIUK struct {
+	Salt       []byte
+	Params     Argon2Params
+	Nonce      []byte
+	Ciphertext []byte
+}
+
+// Seal derives a wrapping key from rescueCode using Argon2id and
+// params, generates a fresh random salt, and uses the derived key to
+// encrypt iuk.
+func Seal(rescueCode string, iuk []byte, params Argon2Params) (*SealedIUK, error) {
+	if err := validateRescueCode(rescueCode); err != nil {
+		return nil, err
+	}
+
+	salt := make([]byte, 16)
+	if _, err := io.ReadFull(rand.Reader, salt); err != nil {
+		return nil, err
+	}
+
+	aesgcm, err := cipherFor(rescueCode, salt, params)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, aesgcm.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+
+	return &SealedIUK{
+		Salt:       salt,
+		Params:     params,
+		Nonce:      nonce,
+		Ciphertext: aesgcm.Seal(nil, nonce, iuk, nil),
+	}, nil
+}
+
+// Unlock recovers the IUK sealed in s using rescueCode. It returns
+// ErrInvalidRescueCode if rescueCode is wrong or s has been
+// tampered with.
+func (s *SealedIUK) Unlock(rescueCode string) ([]byte, error) {
+	if err := validateRescueCode(rescueCode); err != nil {
+		return nil, err
+	}
+
+	aesgcm, err := cipherFor(rescueCode, s.Salt, s.Params)
+	if err != nil {
+		return nil, err
+	}
+
+	iuk, err := aesgcm.Open(nil, s.Nonce, s.Ciphertext, nil)
+	if err != nil {
+		return nil, ErrInvalidRescueCode
+	}
+	return iuk, nil
+}
+
+// Rekey proves ownership of s via oldRescueCode, then seals newIUK
+// under newRescueCode using DefaultArgon2Params. This is the SQRL
+// "New Identity" flow: a client that still knows its rescue code can
+// replace a lost or rotated Identity Master Key without the SP
+// needing any other proof of ownership.
+func (s *SealedIUK) Rekey(oldRescueCode, newRescueCode string, newIUK []byte) (*SealedIUK, error) {
+	if _, err := s.Unlock(oldRescueCode); err != nil {
+		return nil, err
+	}
+	return Seal(newRescueCode, newIUK, DefaultArgon2Params)
+}
+
+// Command identifies a SQRL client command whose effect on an
+// account is sensitive enough that the SQRL spec requires it to be
+// accompanied by proof of the rescue code (the client's "urs"
+// signature), rather than just the current Identity Master Key
+// signature.
+type Command string
+
+const (
+	// CommandEnable re-enables a previously disabled identity.
+	CommandEnable Command = "enable"
+	// CommandDisable disables an identity without removing it.
+	CommandDisable Command = "disable"
+	// CommandRemove permanently removes an identity from the account.
+	CommandRemove Command = "remove"
+)
+
+// RequiresRescueProof reports whether cmd must be accompanied by
+// proof that the client knows the account's rescue code.
+//
+// CommandDisable is deliberately excluded: SQRL lets a client disable
+// an identity on the strength of its ordinary Identity Master Key
+// signature alone, so a user who suspects their device is compromised
+// can kill it immediately without needing their rescue code on hand.
+// Re-enabling or permanently removing the identity are the sensitive
+// operations and do require the rescue-code-derived "urs" proof.
+func RequiresRescueProof(cmd Command) bool {
+	switch cmd {
+	case CommandEnable, CommandRemove:
+		return true
+	default:
+		return false
+	}
+}
+
+// VerifyRescueProof reports whether rescueCode unlocks s. SPs should
+// call this before honouring any Command for which
+// RequiresRescueProof returns true.
+func VerifyRescueProof(s *SealedIUK, rescueCode string) bool {
+	_, err := s.Unlock(rescueCode)
+	return err == nil
+}
+
+func cipherFor(rescueCode string, salt []byte, params Argon2Params) (cipher.AEAD, error) {
+	key := argon2.IDKey([]byte(rescueCode), salt, params.Time, params.MemoryKiB, params.Threads, params.KeyLen)
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func validateRescueCode(code string) error {
+	if len(code) != RescueCodeLength {
+		return ErrMalformedRescueCode
+	}
+	for _, r := range code {
+		if r < '0' || r > '9' {
+			return ErrMalformedRescueCode
+		}
+	}
+	return nil
+}
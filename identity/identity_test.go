@@ -0,0 +1,164 @@
+package identity
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+// testParams uses minimal Argon2id cost so the KDF runs fast across
+// the many cases below; DefaultArgon2Params is exercised separately.
+var testParams = Argon2Params{Time: 1, MemoryKiB: 8 * 1024, Threads: 1, KeyLen: 32}
+
+const (
+	rescueCode    = "123456789012345678901234"
+	otherCode     = "432109876543210987654321"
+	malformedCode = "not-a-rescue-code"
+)
+
+func TestSealUnlockRoundTrip(t *testing.T) {
+	iuk := []byte("a secret identity unlock key!!!")
+
+	sealed, err := Seal(rescueCode, iuk, testParams)
+	if err != nil {
+		t.Fatalf("Seal: %v", err)
+	}
+
+	got, err := sealed.Unlock(rescueCode)
+	if err != nil {
+		t.Fatalf("Unlock: %v", err)
+	}
+	if !bytes.Equal(got, iuk) {
+		t.Fatalf("Unlock = %q, want %q", got, iuk)
+	}
+}
+
+func TestSealUnlockRoundTripWithDefaultParams(t *testing.T) {
+	iuk := []byte("a secret identity unlock key!!!")
+
+	sealed, err := Seal(rescueCode, iuk, DefaultArgon2Params)
+	if err != nil {
+		t.Fatalf("Seal: %v", err)
+	}
+
+	got, err := sealed.Unlock(rescueCode)
+	if err != nil {
+		t.Fatalf("Unlock: %v", err)
+	}
+	if !bytes.Equal(got, iuk) {
+		t.Fatalf("Unlock = %q, want %q", got, iuk)
+	}
+}
+
+func TestUnlockWrongRescueCode(t *testing.T) {
+	sealed, err := Seal(rescueCode, []byte("iuk"), testParams)
+	if err != nil {
+		t.Fatalf("Seal: %v", err)
+	}
+
+	if _, err := sealed.Unlock(otherCode); !errors.Is(err, ErrInvalidRescueCode) {
+		t.Fatalf("Unlock with wrong rescue code = %v, want ErrInvalidRescueCode", err)
+	}
+}
+
+func TestUnlockTamperedCiphertext(t *testing.T) {
+	sealed, err := Seal(rescueCode, []byte("iuk"), testParams)
+	if err != nil {
+		t.Fatalf("Seal: %v", err)
+	}
+
+	tampered := *sealed
+	tampered.Ciphertext = append([]byte{}, sealed.Ciphertext...)
+	tampered.Ciphertext[0] ^= 0xff
+
+	if _, err := tampered.Unlock(rescueCode); !errors.Is(err, ErrInvalidRescueCode) {
+		t.Fatalf("Unlock with tampered ciphertext = %v, want ErrInvalidRescueCode", err)
+	}
+}
+
+func TestSealRejectsMalformedRescueCode(t *testing.T) {
+	if _, err := Seal(malformedCode, []byte("iuk"), testParams); !errors.Is(err, ErrMalformedRescueCode) {
+		t.Fatalf("Seal with malformed rescue code = %v, want ErrMalformedRescueCode", err)
+	}
+}
+
+func TestUnlockRejectsMalformedRescueCode(t *testing.T) {
+	sealed, err := Seal(rescueCode, []byte("iuk"), testParams)
+	if err != nil {
+		t.Fatalf("Seal: %v", err)
+	}
+
+	if _, err := sealed.Unlock(malformedCode); !errors.Is(err, ErrMalformedRescueCode) {
+		t.Fatalf("Unlock with malformed rescue code = %v, want ErrMalformedRescueCode", err)
+	}
+}
+
+func TestRekey(t *testing.T) {
+	oldIUK := []byte("old identity unlock key")
+	newIUK := []byte("new identity unlock key")
+
+	sealed, err := Seal(rescueCode, oldIUK, testParams)
+	if err != nil {
+		t.Fatalf("Seal: %v", err)
+	}
+
+	rekeyed, err := sealed.Rekey(rescueCode, otherCode, newIUK)
+	if err != nil {
+		t.Fatalf("Rekey: %v", err)
+	}
+
+	got, err := rekeyed.Unlock(otherCode)
+	if err != nil {
+		t.Fatalf("Unlock after Rekey: %v", err)
+	}
+	if !bytes.Equal(got, newIUK) {
+		t.Fatalf("Unlock after Rekey = %q, want %q", got, newIUK)
+	}
+
+	// The old rescue code must no longer unlock the rekeyed blob.
+	if _, err := rekeyed.Unlock(rescueCode); !errors.Is(err, ErrInvalidRescueCode) {
+		t.Fatalf("Unlock(old rescue code) after Rekey = %v, want ErrInvalidRescueCode", err)
+	}
+}
+
+func TestRekeyWithWrongOldRescueCode(t *testing.T) {
+	sealed, err := Seal(rescueCode, []byte("iuk"), testParams)
+	if err != nil {
+		t.Fatalf("Seal: %v", err)
+	}
+
+	if _, err := sealed.Rekey(otherCode, rescueCode, []byte("new iuk")); !errors.Is(err, ErrInvalidRescueCode) {
+		t.Fatalf("Rekey with wrong old rescue code = %v, want ErrInvalidRescueCode", err)
+	}
+}
+
+func TestRequiresRescueProof(t *testing.T) {
+	for _, cmd := range []Command{CommandEnable, CommandRemove} {
+		if !RequiresRescueProof(cmd) {
+			t.Errorf("RequiresRescueProof(%q) = false, want true", cmd)
+		}
+	}
+	// Disable is the one command SQRL lets a client perform with only
+	// its ordinary Identity Master Key signature, so a compromised
+	// device can be killed without the rescue code on hand.
+	if RequiresRescueProof(CommandDisable) {
+		t.Errorf("RequiresRescueProof(%q) = true, want false", CommandDisable)
+	}
+	if RequiresRescueProof(Command("query")) {
+		t.Errorf("RequiresRescueProof(%q) = true, want false", Command("query"))
+	}
+}
+
+func TestVerifyRescueProof(t *testing.T) {
+	sealed, err := Seal(rescueCode, []byte("iuk"), testParams)
+	if err != nil {
+		t.Fatalf("Seal: %v", err)
+	}
+
+	if !VerifyRescueProof(sealed, rescueCode) {
+		t.Error("VerifyRescueProof with the correct rescue code = false, want true")
+	}
+	if VerifyRescueProof(sealed, otherCode) {
+		t.Error("VerifyRescueProof with the wrong rescue code = true, want false")
+	}
+}
@@ -0,0 +1,131 @@
+package sqrl
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"io"
+	"sync"
+	"time"
+)
+
+// KeyProvider supplies the encryption keys a Nutter uses to seal and
+// open nuts. Implementations allow the active key to change over the
+// lifetime of a process without invalidating nuts that were sealed
+// with a previous key and are still outstanding.
+type KeyProvider interface {
+	// CurrentKey returns the key that should be used to seal new nuts,
+	// along with an id that will be embedded in the nut so the same
+	// key can be found again by KeyByID when the nut comes back.
+	CurrentKey() (id string, key []byte)
+
+	// KeyByID returns the key previously handed out with the given id.
+	// ok is false if no such key is known, for example because it has
+	// rotated out of use.
+	KeyByID(id string) (key []byte, ok bool)
+}
+
+// staticKeyProvider always serves the same key and never rotates.
+type staticKeyProvider struct {
+	id  string
+	key []byte
+}
+
+// NewStaticKeyProvider returns a KeyProvider that never rotates its
+// key, always sealing and opening nuts with the given key. This
+// mirrors the behaviour of a Nutter built from a single raw key.
+func NewStaticKeyProvider(key []byte) KeyProvider {
+	return &staticKeyProvider{id: "static", key: key}
+}
+
+func (p *staticKeyProvider) CurrentKey() (string, []byte) {
+	return p.id, p.key
+}
+
+func (p *staticKeyProvider) KeyByID(id string) ([]byte, bool) {
+	if id != p.id {
+		return nil, false
+	}
+	return p.key, true
+}
+
+// rotatingKey is a single generation of an AES key issued by a
+// RotatingKeyProvider.
+type rotatingKey struct {
+	id  string
+	key []byte
+}
+
+// RotatingKeyProvider is the default KeyProvider. It generates a
+// fresh, random AES-256 key on a fixed interval and keeps the
+// previous keepPrevious generations around, so nuts sealed before a
+// rotation remain valid until a Nutter's Expiry catches up with them.
+type RotatingKeyProvider struct {
+	interval     time.Duration
+	keepPrevious int
+
+	mu   sync.Mutex
+	keys []rotatingKey // newest first
+}
+
+// NewRotatingKeyProvider creates a RotatingKeyProvider that rotates
+// its key every interval, retaining the keepPrevious generations
+// before the current one. A key is generated immediately so the
+// provider is ready to use as soon as it is returned.
+func NewRotatingKeyProvider(interval time.Duration, keepPrevious int) *RotatingKeyProvider {
+	p := &RotatingKeyProvider{
+		interval:     interval,
+		keepPrevious: keepPrevious,
+	}
+	p.rotate()
+	go p.rotateEvery(interval)
+	return p
+}
+
+func (p *RotatingKeyProvider) rotateEvery(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	for range ticker.C {
+		p.rotate()
+	}
+}
+
+func (p *RotatingKeyProvider) rotate() {
+	key := make([]byte, 32) // AES-256
+	if _, err := io.ReadFull(rand.Reader, key); err != nil {
+		// As with Nut generation, there is little a caller could do
+		// to recover from a failure to read random bytes here.
+		panic(err.Error())
+	}
+	id := newKeyID()
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.keys = append([]rotatingKey{{id: id, key: key}}, p.keys...)
+	if max := p.keepPrevious + 1; len(p.keys) > max {
+		p.keys = p.keys[:max]
+	}
+}
+
+// CurrentKey returns the most recently generated key.
+func (p *RotatingKeyProvider) CurrentKey() (string, []byte) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	current := p.keys[0]
+	return current.id, current.key
+}
+
+// KeyByID returns the key generated with the given id, provided it
+// hasn't yet rotated out of the retained generations.
+func (p *RotatingKeyProvider) KeyByID(id string) ([]byte, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, k := range p.keys {
+		if k.id == id {
+			return k.key, true
+		}
+	}
+	return nil, false
+}
+
+func newKeyID() string {
+	return hex.EncodeToString(randBytes(4))
+}
@@ -9,10 +9,19 @@ import (
 	"encoding/binary"
 	"errors"
 	"io"
+	"sync"
 	"sync/atomic"
 	"time"
 )
 
+// maxCachedCiphers bounds how many distinct key ids' worth of
+// cipher.AEAD a Nutter will cache at once. It comfortably exceeds the
+// generations a KeyProvider such as RotatingKeyProvider would
+// realistically keep alive at any one time, so in normal operation
+// nothing is ever evicted; it only caps memory for a KeyProvider that
+// rotates forever over the life of the process.
+const maxCachedCiphers = 16
+
 // Nutter generates new nuts used to issue
 // unique challenges to a SQRL client. It is
 // also used to validate nuts that were
@@ -20,23 +29,55 @@ import (
 type Nutter struct {
 	Expiry time.Duration
 
-	key    []byte
-	aesgcm cipher.AEAD
+	keys KeyProvider
+
+	mu        sync.Mutex
+	ciphers   map[string]cipher.AEAD
+	cipherIDs []string // insertion order, oldest first, for eviction
 }
 
-// NewNutter creates a Nut generator
-// with the given encryption key and a
-// default nut expiry of 5 minutes.
-// TODO: Key rotation
-func NewNutter(key []byte) *Nutter {
-	aesgcm := genAesgcm(key)
+// NewNutter creates a Nut generator that seals and opens
+// nuts using the keys served by the given KeyProvider, with
+// a default nut expiry of 5 minutes.
+//
+// Sealing a nut embeds the id of the key used, so that keys
+// served by a KeyProvider may be rotated without invalidating
+// nuts that are already in flight; Validate simply asks the
+// KeyProvider for the key matching the id found in the nut.
+func NewNutter(keys KeyProvider) *Nutter {
 	return &Nutter{
-		key:    key,
-		aesgcm: aesgcm,
-		Expiry: time.Minute * 5,
+		keys:    keys,
+		ciphers: map[string]cipher.AEAD{},
+		Expiry:  time.Minute * 5,
 	}
 }
 
+// cipherFor returns the AEAD for the given key id, creating and
+// caching one from key if this is the first time id has been seen.
+// Caching is only an optimisation: a cipher.AEAD is cheap to rebuild
+// from its key, so cipherFor evicts the oldest entry once the cache
+// grows past maxCachedCiphers rather than letting a KeyProvider that
+// rotates forever (e.g. RotatingKeyProvider) grow it without bound.
+func (n *Nutter) cipherFor(id string, key []byte) cipher.AEAD {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if aesgcm, ok := n.ciphers[id]; ok {
+		return aesgcm
+	}
+
+	aesgcm := genAesgcm(key)
+	n.ciphers[id] = aesgcm
+	n.cipherIDs = append(n.cipherIDs, id)
+
+	if len(n.cipherIDs) > maxCachedCiphers {
+		var oldest string
+		oldest, n.cipherIDs = n.cipherIDs[0], n.cipherIDs[1:]
+		delete(n.ciphers, oldest)
+	}
+
+	return aesgcm
+}
+
 func genAesgcm(key []byte) cipher.AEAD {
 	padKeyIfRequired(key)
 	block, err := aes.NewCipher(key)
@@ -66,6 +107,22 @@ var nuts uint32
 // metadata about the request that it was derived from.
 type Nut string
 
+// NutSource records how a Nut was delivered to the SQRL client,
+// which is embedded in the Nut itself so it can be recovered again
+// by Inspect once the client returns it.
+type NutSource int
+
+const (
+	// SourceQR indicates the Nut was displayed as a QR code, implying
+	// the client that scans it is on a different device to the
+	// browser that requested the Nut.
+	SourceQR NutSource = iota
+	// SourceLink indicates the Nut was embedded in a sqrl:// link the
+	// user followed directly, implying the SQRL client is on the same
+	// device as the browser. SPs typically offer CPS for this case.
+	SourceLink
+)
+
 func (n Nut) String() string {
 	return string(n)
 }
@@ -87,7 +144,17 @@ func (n Nut) String() string {
 // Alternatively, NoClientID can be used to skip the client
 // identification check. This should only be used if client
 // identification is not possible.
+//
+// The returned Nut is flagged as having come from a QR code; use
+// NutWithSource to flag a same-device sqrl:// link instead.
 func (n *Nutter) Nut(clientIdentifier string) Nut {
+	return n.NutWithSource(clientIdentifier, SourceQR)
+}
+
+// NutWithSource behaves like Nut, additionally embedding src so that
+// Inspect can later tell a same-device login flow (SourceLink) apart
+// from a cross-device one (SourceQR).
+func (n *Nutter) NutWithSource(clientIdentifier string, src NutSource) Nut {
 	//  32 bits: user's connection IP address if secured, 0.0.0.0 if non-secured.
 	//  32 bits: UNIX-time timestamp incrementing once per second.
 	//  32 bits: up-counter incremented once for every SQRL link generated.
@@ -128,12 +195,31 @@ func (n *Nutter) Nut(clientIdentifier string) Nut {
 	nut[15] = noise[3]
 
 	//   1  bit: flag bit to indicate source: QRcode or URL click
-	// TODO
+	nut[15] &^= 1
+	if src == SourceLink {
+		nut[15] |= 1
+	}
+
+	keyID, key := n.keys.CurrentKey()
+	aesgcm := n.cipherFor(keyID, key)
+
+	nonce := randBytes(aesgcm.NonceSize())
+	encryptedNut := aesgcm.Seal(nil, nonce, nut, nil)
+
+	sealed := encodeKeyID(keyID)
+	sealed = append(sealed, nonce...)
+	sealed = append(sealed, encryptedNut...)
+	return Nut(Base64.EncodeToString(sealed))
+}
 
-	nonce := randBytes(n.aesgcm.NonceSize())
-	encryptedNut := n.aesgcm.Seal(nil, nonce, nut, nil)
-	encryptedNutAndNonce := append(nonce, encryptedNut...)
-	return Nut(Base64.EncodeToString(encryptedNutAndNonce))
+// encodeKeyID prepends a length-prefixed key id header to a sealed nut,
+// so the key used to seal it can be recovered without trying every key
+// the KeyProvider knows about.
+func encodeKeyID(id string) []byte {
+	idBytes := []byte(id)
+	header := make([]byte, 1, 1+len(idBytes))
+	header[0] = byte(len(idBytes))
+	return append(header, idBytes...)
 }
 
 // Validate checks a nut returned by a client to ensure the nut
@@ -149,9 +235,26 @@ func (n *Nutter) Nut(clientIdentifier string) Nut {
 // The nut's expiry is also checked, to ensure there hasn't been
 // a significant delay between nut issuing and nut return.
 func (n *Nutter) Validate(returned Nut, clientIdentifier string) bool {
+	_, ok := n.Inspect(returned, clientIdentifier)
+	return ok
+}
+
+// NutInfo describes the metadata recovered from a nut by Inspect.
+type NutInfo struct {
+	// Source records whether the nut was issued for a QR code or a
+	// same-device sqrl:// link, as passed to NutWithSource.
+	Source NutSource
+}
+
+// Inspect validates returned exactly as Validate does, and also
+// decodes the metadata embedded in it by NutWithSource, so callers
+// can distinguish a same-device login from a cross-device one and
+// drive different UX (e.g. whether to offer CPS) accordingly. The
+// returned NutInfo is only meaningful when ok is true.
+func (n *Nutter) Inspect(returned Nut, clientIdentifier string) (info NutInfo, ok bool) {
 	decryptedNut, err := n.decryptNut(returned)
 	if err != nil || len(decryptedNut) != 16 {
-		return false // TODO: Do we need to expose this error?
+		return NutInfo{}, false // TODO: Do we need to expose this error?
 	}
 
 	originalIP := decryptedNut[:4]
@@ -159,28 +262,51 @@ func (n *Nutter) Validate(returned Nut, clientIdentifier string) bool {
 	if !shouldCheckIP {
 		ip := nutClientIDBytes(clientIdentifier)
 		if ipMatch := bytes.Equal(ip, originalIP); !ipMatch {
-			return false
+			return NutInfo{}, false
 		}
 	}
 
 	timeSeconds := binary.BigEndian.Uint32(decryptedNut[4:8])
 	t := time.Unix(int64(timeSeconds), 0)
-	return time.Since(t) <= n.Expiry
+	if time.Since(t) > n.Expiry {
+		return NutInfo{}, false
+	}
+
+	source := SourceQR
+	if decryptedNut[15]&1 == 1 {
+		source = SourceLink
+	}
+	return NutInfo{Source: source}, true
 }
 
 func (n *Nutter) decryptNut(encrypted Nut) ([]byte, error) {
-	decodedNutAndNonce, err := Base64.DecodeString(string(encrypted))
+	decoded, err := Base64.DecodeString(string(encrypted))
 	if err != nil {
 		return nil, err
 	}
-	nonceSize := n.aesgcm.NonceSize()
-	if len(decodedNutAndNonce) <= nonceSize {
+	if len(decoded) < 1 {
+		return nil, errors.New("invalid nut")
+	}
+	idLen := int(decoded[0])
+	if len(decoded) < 1+idLen {
+		return nil, errors.New("invalid nut")
+	}
+	keyID := string(decoded[1 : 1+idLen])
+	key, ok := n.keys.KeyByID(keyID)
+	if !ok {
+		return nil, errors.New("unknown nut key")
+	}
+	aesgcm := n.cipherFor(keyID, key)
+
+	nonceAndCiphertext := decoded[1+idLen:]
+	nonceSize := aesgcm.NonceSize()
+	if len(nonceAndCiphertext) <= nonceSize {
 		return nil, errors.New("invalid nut")
 	}
-	nonce := decodedNutAndNonce[:nonceSize]
-	encryptedNut := decodedNutAndNonce[nonceSize:]
+	nonce := nonceAndCiphertext[:nonceSize]
+	encryptedNut := nonceAndCiphertext[nonceSize:]
 
-	return n.aesgcm.Open(nil, nonce, encryptedNut, nil)
+	return aesgcm.Open(nil, nonce, encryptedNut, nil)
 }
 
 func nutClientIDBytes(clientIdentifier string) []byte {
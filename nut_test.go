@@ -0,0 +1,88 @@
+package sqrl
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestCipherForCachesAndEvictsOldestID(t *testing.T) {
+	n := NewNutter(NewStaticKeyProvider(make([]byte, 16)))
+	key := make([]byte, 16)
+
+	first := n.cipherFor("id-0", key)
+	if again := n.cipherFor("id-0", key); again != first {
+		t.Fatalf("cipherFor returned a different cipher for the same id")
+	}
+
+	for i := 1; i <= maxCachedCiphers; i++ {
+		n.cipherFor(fmt.Sprintf("id-%d", i), key)
+	}
+
+	if len(n.ciphers) != maxCachedCiphers {
+		t.Fatalf("len(n.ciphers) = %d, want %d", len(n.ciphers), maxCachedCiphers)
+	}
+	if _, ok := n.ciphers["id-0"]; ok {
+		t.Fatalf("cipherFor did not evict the oldest id once the cache grew past maxCachedCiphers")
+	}
+}
+
+func TestDecryptNutRecreatesAnEvictedCipher(t *testing.T) {
+	n := NewNutter(NewStaticKeyProvider(make([]byte, 16)))
+	nut := n.Nut(NoClientID)
+
+	// Evicting the static key's cached cipher must not affect whether
+	// the key itself is still valid: KeyByID still returns it, so
+	// cipherFor should simply rebuild it on demand.
+	for i := 0; i < maxCachedCiphers; i++ {
+		n.cipherFor(fmt.Sprintf("filler-%d", i), make([]byte, 16))
+	}
+	if _, ok := n.ciphers["static"]; ok {
+		t.Fatalf("expected the static key's cipher to have been evicted by the filler ids")
+	}
+
+	if !n.Validate(nut, NoClientID) {
+		t.Fatalf("Validate failed for a nut whose cipher had been evicted from the cache")
+	}
+}
+
+func TestNutRoundTripsAcrossKeyRotation(t *testing.T) {
+	provider := &RotatingKeyProvider{interval: time.Hour, keepPrevious: 1}
+	provider.rotate()
+	n := NewNutter(provider)
+
+	nut := n.Nut(NoClientID)
+
+	provider.rotate() // one rotation: the sealing key is now the previous generation
+	if !n.Validate(nut, NoClientID) {
+		t.Fatalf("Validate failed after a single rotation with keepPrevious=1")
+	}
+
+	provider.rotate() // a second rotation should age the sealing key out entirely
+	if n.Validate(nut, NoClientID) {
+		t.Fatalf("Validate succeeded for a nut sealed under a key that should have rotated out")
+	}
+}
+
+func TestInspectRecoversNutSource(t *testing.T) {
+	n := NewNutter(NewStaticKeyProvider(make([]byte, 16)))
+
+	qrNut := n.NutWithSource(NoClientID, SourceQR)
+	if info, ok := n.Inspect(qrNut, NoClientID); !ok || info.Source != SourceQR {
+		t.Fatalf("Inspect(QR nut) = %+v, ok=%v; want Source SourceQR, ok true", info, ok)
+	}
+
+	linkNut := n.NutWithSource(NoClientID, SourceLink)
+	if info, ok := n.Inspect(linkNut, NoClientID); !ok || info.Source != SourceLink {
+		t.Fatalf("Inspect(link nut) = %+v, ok=%v; want Source SourceLink, ok true", info, ok)
+	}
+}
+
+func TestNutDefaultsToSourceQR(t *testing.T) {
+	n := NewNutter(NewStaticKeyProvider(make([]byte, 16)))
+
+	nut := n.Nut(NoClientID)
+	if info, ok := n.Inspect(nut, NoClientID); !ok || info.Source != SourceQR {
+		t.Fatalf("Inspect(Nut(...)) = %+v, ok=%v; want Source SourceQR, ok true", info, ok)
+	}
+}
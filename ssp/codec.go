@@ -0,0 +1,85 @@
+package ssp
+
+import (
+	"fmt"
+
+	"github.com/fxamacker/cbor/v2"
+)
+
+// codecVersion is prefixed to every record encoded by this file, so
+// that a future change to Transaction, Token or User's fields can be
+// decoded unambiguously alongside older records already written to a
+// Store or in flight to a peer.
+const codecVersion byte = 1
+
+var encMode = newDeterministicEncMode()
+
+func newDeterministicEncMode() cbor.EncMode {
+	mode, err := cbor.CanonicalEncOptions().EncMode()
+	if err != nil {
+		panic(err)
+	}
+	return mode
+}
+
+// MarshalTransaction encodes t as a versioned, deterministic CBOR
+// record suitable for storage or for streaming to a peer via a
+// ReplicatingStore's Transport.
+func MarshalTransaction(t *Transaction) ([]byte, error) {
+	return marshalRecord(t)
+}
+
+// UnmarshalTransaction decodes a record previously produced by
+// MarshalTransaction.
+func UnmarshalTransaction(data []byte) (*Transaction, error) {
+	var t Transaction
+	if err := unmarshalRecord(data, &t); err != nil {
+		return nil, err
+	}
+	return &t, nil
+}
+
+// MarshalToken encodes token the same way MarshalTransaction does.
+func MarshalToken(token Token) ([]byte, error) {
+	return marshalRecord(token)
+}
+
+// UnmarshalToken decodes a record previously produced by
+// MarshalToken.
+func UnmarshalToken(data []byte) (Token, error) {
+	var token Token
+	err := unmarshalRecord(data, &token)
+	return token, err
+}
+
+// MarshalUser encodes user the same way MarshalTransaction does.
+func MarshalUser(user *User) ([]byte, error) {
+	return marshalRecord(user)
+}
+
+// UnmarshalUser decodes a record previously produced by MarshalUser.
+func UnmarshalUser(data []byte) (*User, error) {
+	var user User
+	if err := unmarshalRecord(data, &user); err != nil {
+		return nil, err
+	}
+	return &user, nil
+}
+
+func marshalRecord(v interface{}) ([]byte, error) {
+	body, err := encMode.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte{codecVersion}, body...), nil
+}
+
+func unmarshalRecord(data []byte, v interface{}) error {
+	if len(data) < 1 {
+		return fmt.Errorf("ssp: empty encoded record")
+	}
+	if version := data[0]; version != codecVersion {
+		return fmt.Errorf("ssp: unsupported codec version %d", version)
+	}
+	return cbor.Unmarshal(data[1:], v)
+}
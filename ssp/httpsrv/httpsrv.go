@@ -0,0 +1,112 @@
+// Package httpsrv hosts a SQRL SP's nut/ident/query endpoints over
+// HTTPS, obtaining and renewing certificates from Let's Encrypt via
+// golang.org/x/crypto/acme/autocert.
+//
+// SQRL depends on the SP presenting a stable, trusted TLS identity,
+// so this package also guards against the most common way that gets
+// broken by accident: handing a client a qrl:// URL, which only works
+// unencrypted. Every client-facing SQRL URL must use the sqrl://
+// scheme, never qrl://.
+package httpsrv
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+
+	"golang.org/x/crypto/acme/autocert"
+
+	"github.com/RaniSputnik/sqrl-go/ssp"
+)
+
+// Scheme is the only URL scheme this package will hand to a SQRL
+// client. qrl:// is SQRL's plain-HTTP variant, so it is never used for
+// URLs a client is asked to trust as the identity of the SP.
+const Scheme = "sqrl://"
+
+// ErrInsecureScheme is returned when a SQRL URL does not use Scheme.
+var ErrInsecureScheme = errors.New("httpsrv: SQRL URLs must use the sqrl:// scheme")
+
+// RequireSQRLScheme checks that rawurl begins with Scheme, returning
+// ErrInsecureScheme otherwise. Handlers that build SQRL URLs for a
+// response (e.g. the initial QR code or login link) should call this
+// before writing them out.
+func RequireSQRLScheme(rawurl string) error {
+	if !strings.HasPrefix(rawurl, Scheme) {
+		return ErrInsecureScheme
+	}
+	return nil
+}
+
+// NewAutocertCache adapts store to autocert.Cache, so the same
+// database or Redis instance already backing an SP's transactions,
+// tokens and users can also hold its Let's Encrypt account key and
+// certificates. store must be one of the ssp.Store implementations
+// that also satisfy ssp.CertCache (currently the sql and redis
+// stores); passing any other Store is a programming error and panics.
+func NewAutocertCache(store ssp.Store) autocert.Cache {
+	cache, ok := store.(ssp.CertCache)
+	if !ok {
+		panic("httpsrv: store does not implement ssp.CertCache")
+	}
+	return cache
+}
+
+// Server hosts a SQRL SP's endpoints over HTTPS, using autocert to
+// obtain and renew certificates on demand.
+type Server struct {
+	manager *autocert.Manager
+	srv     *http.Server
+}
+
+// New creates a Server that serves handler over HTTPS for the given
+// hosts, persisting autocert's account key and certificates to store.
+//
+// hostPolicy overrides the default policy of only issuing
+// certificates for hosts; pass nil to use the default. A custom
+// hostPolicy is useful for SPs serving a dynamic set of hostnames,
+// e.g. one certificate per tenant.
+func New(handler http.Handler, store ssp.Store, hosts []string, hostPolicy autocert.HostPolicy) *Server {
+	if hostPolicy == nil {
+		hostPolicy = autocert.HostWhitelist(hosts...)
+	}
+	manager := &autocert.Manager{
+		Prompt:     autocert.AcceptTOS,
+		HostPolicy: hostPolicy,
+		Cache:      NewAutocertCache(store),
+	}
+	return &Server{
+		manager: manager,
+		srv: &http.Server{
+			Handler:   handler,
+			TLSConfig: manager.TLSConfig(),
+		},
+	}
+}
+
+// ListenAndServeHTTPS serves the SP's endpoints on addr over TLS,
+// obtaining certificates from Let's Encrypt as they're needed.
+func (s *Server) ListenAndServeHTTPS(addr string) error {
+	s.srv.Addr = addr
+	return s.srv.ListenAndServeTLS("", "")
+}
+
+// HTTPHandler returns a handler for plain HTTP that answers the
+// ACME HTTP-01 challenge autocert uses to prove domain ownership, and
+// redirects every other request to the equivalent HTTPS URL. A SQRL
+// SP must never serve its nut/ident/query endpoints over plain HTTP,
+// so this is the only thing that should ever be listening on :80.
+func (s *Server) HTTPHandler() http.Handler {
+	return s.manager.HTTPHandler(http.HandlerFunc(redirectToHTTPS))
+}
+
+func redirectToHTTPS(w http.ResponseWriter, r *http.Request) {
+	target := "https://" + r.Host + r.URL.RequestURI()
+	http.Redirect(w, r, target, http.StatusMovedPermanently)
+}
+
+// Shutdown gracefully stops the HTTPS server.
+func (s *Server) Shutdown(ctx context.Context) error {
+	return s.srv.Shutdown(ctx)
+}
@@ -0,0 +1,69 @@
+package ssp
+
+// Dialect identifies which flavour of SQL a sqlStore should speak,
+// since column types and upsert syntax differ slightly between
+// backends even though the schema itself is shared.
+type Dialect int
+
+const (
+	// DialectPostgres targets PostgreSQL, e.g. via github.com/lib/pq.
+	DialectPostgres Dialect = iota
+	// DialectSQLite targets SQLite, e.g. via github.com/mattn/go-sqlite3.
+	DialectSQLite
+)
+
+// migrationsFor returns the ordered set of DDL statements required to
+// bring a fresh database up to the schema a sqlStore expects. Every
+// statement is idempotent so Migrate can be called on every start up.
+func migrationsFor(dialect Dialect) []string {
+	blob := "BYTEA"
+	if dialect == DialectSQLite {
+		blob = "BLOB"
+	}
+
+	return []string{
+		`CREATE TABLE IF NOT EXISTS transactions (
+			id TEXT PRIMARY KEY,
+			next TEXT NOT NULL,
+			first_id TEXT NOT NULL,
+			payload ` + blob + ` NOT NULL,
+			created_at TIMESTAMP NOT NULL
+		)`,
+		`CREATE UNIQUE INDEX IF NOT EXISTS transactions_next_idx ON transactions (next)`,
+		`CREATE INDEX IF NOT EXISTS transactions_first_id_idx ON transactions (first_id)`,
+
+		`CREATE TABLE IF NOT EXISTS tokens (
+			nut TEXT PRIMARY KEY,
+			payload ` + blob + ` NOT NULL,
+			created_at TIMESTAMP NOT NULL
+		)`,
+
+		`CREATE TABLE IF NOT EXISTS users (
+			id TEXT PRIMARY KEY,
+			idk TEXT NOT NULL,
+			payload ` + blob + ` NOT NULL,
+			created_at TIMESTAMP NOT NULL
+		)`,
+		`CREATE UNIQUE INDEX IF NOT EXISTS users_idk_idx ON users (idk)`,
+
+		// cache holds arbitrary key/value blobs, e.g. the Let's Encrypt
+		// account key and certificates ssp/httpsrv stores via CertCache.
+		`CREATE TABLE IF NOT EXISTS cache (
+			key TEXT PRIMARY KEY,
+			data ` + blob + ` NOT NULL
+		)`,
+
+		// identity_locks holds each user's rescue-code-sealed Identity
+		// Unlock Key, one per user, as persisted via IdentityLockStore.
+		`CREATE TABLE IF NOT EXISTS identity_locks (
+			user_id TEXT PRIMARY KEY,
+			salt ` + blob + ` NOT NULL,
+			argon2_time INTEGER NOT NULL,
+			argon2_memory_kib INTEGER NOT NULL,
+			argon2_threads INTEGER NOT NULL,
+			argon2_key_len INTEGER NOT NULL,
+			nonce ` + blob + ` NOT NULL,
+			ciphertext ` + blob + ` NOT NULL
+		)`,
+	}
+}
@@ -0,0 +1,129 @@
+package ssp
+
+import (
+	"context"
+	"fmt"
+
+	sqrl "github.com/RaniSputnik/sqrl-go"
+)
+
+// Transport delivers encoded Mutations to the other nodes in a
+// cluster. Implementations might publish to a message queue, gossip
+// to known peers, or fan out over gRPC; ReplicatingStore doesn't care
+// how, only that Send reliably reaches the rest of the cluster.
+type Transport interface {
+	Send(ctx context.Context, m Mutation) error
+}
+
+// MutationKind identifies which Store method produced a Mutation, so
+// a receiving node knows how to Apply it.
+type MutationKind byte
+
+const (
+	// MutationSaveTransaction replicates a call to SaveTransaction.
+	MutationSaveTransaction MutationKind = iota + 1
+	// MutationSaveIdentSuccess replicates a call to SaveIdentSuccess.
+	MutationSaveIdentSuccess
+	// MutationCreateUser replicates a call to CreateUser.
+	MutationCreateUser
+)
+
+// Mutation is a single encoded write accepted by a ReplicatingStore,
+// ready to be streamed to the rest of a cluster over a Transport.
+type Mutation struct {
+	Kind MutationKind
+	Data []byte
+}
+
+// identSuccessMutation bundles the two arguments SaveIdentSuccess
+// takes so they can be replicated as a single encoded record.
+type identSuccessMutation struct {
+	Nut   sqrl.Nut
+	Token Token
+}
+
+// ReplicatingStore wraps a Store and streams every mutation it
+// accepts to a Transport, so other nodes in a cluster can Apply the
+// same change locally. Nuts are handed out round-robin across a
+// cluster, so any node may need to serve a client's next request even
+// though a different node first saw the transaction that preceded
+// it; replication is what lets it do so.
+type ReplicatingStore struct {
+	Store
+	transport Transport
+}
+
+// NewReplicatingStore wraps store so that every mutation accepted
+// through it is also encoded and sent to transport.
+func NewReplicatingStore(store Store, transport Transport) *ReplicatingStore {
+	return &ReplicatingStore{Store: store, transport: transport}
+}
+
+func (r *ReplicatingStore) SaveTransaction(ctx context.Context, t *Transaction) error {
+	if err := r.Store.SaveTransaction(ctx, t); err != nil {
+		return err
+	}
+	return r.send(ctx, MutationSaveTransaction, t)
+}
+
+func (r *ReplicatingStore) SaveIdentSuccess(ctx context.Context, nut sqrl.Nut, token Token) error {
+	if err := r.Store.SaveIdentSuccess(ctx, nut, token); err != nil {
+		return err
+	}
+	return r.send(ctx, MutationSaveIdentSuccess, identSuccessMutation{Nut: nut, Token: token})
+}
+
+func (r *ReplicatingStore) CreateUser(ctx context.Context, idk sqrl.Identity) (*User, error) {
+	user, err := r.Store.CreateUser(ctx, idk)
+	if err != nil {
+		return nil, err
+	}
+	if err := r.send(ctx, MutationCreateUser, user); err != nil {
+		return nil, err
+	}
+	return user, nil
+}
+
+func (r *ReplicatingStore) send(ctx context.Context, kind MutationKind, v interface{}) error {
+	data, err := marshalRecord(v)
+	if err != nil {
+		return err
+	}
+	return r.transport.Send(ctx, Mutation{Kind: kind, Data: data})
+}
+
+// Apply decodes and applies a Mutation received from a peer's
+// Transport to store. Peers are expected to read Mutations as they
+// arrive and call Apply for each one to keep their local Store in
+// sync with the node that originally accepted the write.
+func Apply(ctx context.Context, store Store, m Mutation) error {
+	switch m.Kind {
+	case MutationSaveTransaction:
+		var t Transaction
+		if err := unmarshalRecord(m.Data, &t); err != nil {
+			return err
+		}
+		return store.SaveTransaction(ctx, &t)
+
+	case MutationSaveIdentSuccess:
+		var payload identSuccessMutation
+		if err := unmarshalRecord(m.Data, &payload); err != nil {
+			return err
+		}
+		return store.SaveIdentSuccess(ctx, payload.Nut, payload.Token)
+
+	case MutationCreateUser:
+		var user User
+		if err := unmarshalRecord(m.Data, &user); err != nil {
+			return err
+		}
+		replicator, ok := store.(UserReplicator)
+		if !ok {
+			return fmt.Errorf("ssp: store does not support replicating users")
+		}
+		return replicator.PutUser(ctx, &user)
+
+	default:
+		return fmt.Errorf("ssp: unknown mutation kind %d", m.Kind)
+	}
+}
@@ -0,0 +1,175 @@
+package ssp
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	sqrl "github.com/RaniSputnik/sqrl-go"
+)
+
+// storeContractTest exercises the behavioural contract every Store
+// implementation must satisfy, regardless of backend. Each backend's
+// own test file calls this against a freshly created instance so the
+// same assertions run for the in-memory, SQL and Redis stores alike.
+func storeContractTest(t *testing.T, newStore func(t *testing.T) Store) {
+	ctx := context.Background()
+
+	t.Run("GetFirstTransaction resolves a chain to its first transaction", func(t *testing.T) {
+		store := newStore(t)
+
+		first := &Transaction{Id: sqrl.Nut("nut-1"), Next: sqrl.Nut("nut-2")}
+		if err := store.SaveTransaction(ctx, first); err != nil {
+			t.Fatalf("SaveTransaction: %v", err)
+		}
+
+		second := &Transaction{Id: sqrl.Nut("nut-2"), Next: sqrl.Nut("nut-3")}
+		if err := store.SaveTransaction(ctx, second); err != nil {
+			t.Fatalf("SaveTransaction: %v", err)
+		}
+
+		got, err := store.GetFirstTransaction(ctx, second.Next)
+		if err != nil {
+			t.Fatalf("GetFirstTransaction: %v", err)
+		}
+		if got == nil || got.Id != first.Id {
+			t.Fatalf("GetFirstTransaction = %+v, want a transaction with Id %q", got, first.Id)
+		}
+	})
+
+	t.Run("GetFirstTransaction is nil for an unknown nut", func(t *testing.T) {
+		store := newStore(t)
+
+		got, err := store.GetFirstTransaction(ctx, sqrl.Nut("missing"))
+		if err != nil {
+			t.Fatalf("GetFirstTransaction: %v", err)
+		}
+		if got != nil {
+			t.Fatalf("GetFirstTransaction = %+v, want nil", got)
+		}
+	})
+
+	t.Run("ident success round-trips", func(t *testing.T) {
+		store := newStore(t)
+		nut := sqrl.Nut("nut-ident")
+		var token Token
+
+		if err := store.SaveIdentSuccess(ctx, nut, token); err != nil {
+			t.Fatalf("SaveIdentSuccess: %v", err)
+		}
+		got, err := store.GetIdentSuccess(ctx, nut)
+		if err != nil {
+			t.Fatalf("GetIdentSuccess: %v", err)
+		}
+		if !reflect.DeepEqual(got, token) {
+			t.Fatalf("GetIdentSuccess = %+v, want %+v", got, token)
+		}
+	})
+
+	t.Run("GetIdentSuccess is zero value for an unknown nut", func(t *testing.T) {
+		store := newStore(t)
+
+		got, err := store.GetIdentSuccess(ctx, sqrl.Nut("missing"))
+		if err != nil {
+			t.Fatalf("GetIdentSuccess: %v", err)
+		}
+		var zero Token
+		if !reflect.DeepEqual(got, zero) {
+			t.Fatalf("GetIdentSuccess = %+v, want zero value", got)
+		}
+	})
+
+	t.Run("CreateUser can be looked up by identity", func(t *testing.T) {
+		store := newStore(t)
+		idk := sqrl.Identity("identity-1")
+
+		created, err := store.CreateUser(ctx, idk)
+		if err != nil {
+			t.Fatalf("CreateUser: %v", err)
+		}
+		if created.Idk != idk {
+			t.Fatalf("CreateUser user.Idk = %q, want %q", created.Idk, idk)
+		}
+
+		found, err := store.GetUserByIdentity(ctx, idk)
+		if err != nil {
+			t.Fatalf("GetUserByIdentity: %v", err)
+		}
+		if found == nil || found.Id != created.Id {
+			t.Fatalf("GetUserByIdentity = %+v, want a user with Id %q", found, created.Id)
+		}
+	})
+
+	t.Run("GetUserByIdentity is nil for an unknown identity", func(t *testing.T) {
+		store := newStore(t)
+
+		found, err := store.GetUserByIdentity(ctx, sqrl.Identity("missing"))
+		if err != nil {
+			t.Fatalf("GetUserByIdentity: %v", err)
+		}
+		if found != nil {
+			t.Fatalf("GetUserByIdentity = %+v, want nil", found)
+		}
+	})
+
+	t.Run("CreateUser rejects a second user for an identity already in use", func(t *testing.T) {
+		store := newStore(t)
+		idk := sqrl.Identity("identity-dup")
+
+		if _, err := store.CreateUser(ctx, idk); err != nil {
+			t.Fatalf("CreateUser: %v", err)
+		}
+		if _, err := store.CreateUser(ctx, idk); err == nil {
+			t.Fatalf("CreateUser with a duplicate identity succeeded, want an error")
+		}
+	})
+
+	t.Run("PutUser silently drops a conflicting idk but still updates its own id", func(t *testing.T) {
+		store := newStore(t)
+		replicator, ok := store.(UserReplicator)
+		if !ok {
+			t.Skip("store does not implement UserReplicator")
+		}
+		idk := sqrl.Identity("identity-put")
+
+		first := &User{Id: "user-1", Idk: idk}
+		if err := replicator.PutUser(ctx, first); err != nil {
+			t.Fatalf("PutUser: %v", err)
+		}
+
+		conflicting := &User{Id: "user-2", Idk: idk}
+		if err := replicator.PutUser(ctx, conflicting); err != nil {
+			t.Fatalf("PutUser with a conflicting idk returned an error instead of a silent no-op: %v", err)
+		}
+
+		found, err := store.GetUserByIdentity(ctx, idk)
+		if err != nil {
+			t.Fatalf("GetUserByIdentity: %v", err)
+		}
+		if found == nil || found.Id != first.Id {
+			t.Fatalf("GetUserByIdentity = %+v, want the first PutUser (Id %q) to win", found, first.Id)
+		}
+
+		// Re-applying the same id must still update the record rather
+		// than being treated as a conflict with itself.
+		updated := &User{Id: first.Id, Idk: idk}
+		if err := replicator.PutUser(ctx, updated); err != nil {
+			t.Fatalf("PutUser re-applying the same id: %v", err)
+		}
+
+		// Re-applying the same id with a new idk must move the record
+		// over to it, proving the write was applied and not dropped.
+		movedIdk := sqrl.Identity("identity-put-moved")
+		moved := &User{Id: first.Id, Idk: movedIdk}
+		if err := replicator.PutUser(ctx, moved); err != nil {
+			t.Fatalf("PutUser re-applying the same id with a new idk: %v", err)
+		}
+		found, err = store.GetUserByIdentity(ctx, movedIdk)
+		if err != nil {
+			t.Fatalf("GetUserByIdentity: %v", err)
+		}
+		if found == nil || found.Id != first.Id {
+			t.Fatalf("GetUserByIdentity after re-applying id %q with a new idk = %+v, want that user", first.Id, found)
+		}
+	})
+}
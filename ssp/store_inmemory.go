@@ -70,6 +70,11 @@ func (s *inmemoryStore) GetIdentSuccess(ctx context.Context, nut sqrl.Nut) (toke
 func (s *inmemoryStore) CreateUser(ctx context.Context, idk sqrl.Identity) (*User, error) {
 	s.Lock()
 	defer s.Unlock()
+	for _, existing := range s.users {
+		if existing.Idk == idk {
+			return nil, fmt.Errorf("ssp: user already exists for identity")
+		}
+	}
 	newUser := &User{
 		Id:  uuid(),
 		Idk: idk,
@@ -0,0 +1,9 @@
+package ssp
+
+import "testing"
+
+func TestInMemoryStore(t *testing.T) {
+	storeContractTest(t, func(t *testing.T) Store {
+		return NewMemoryStore()
+	})
+}
@@ -0,0 +1,236 @@
+package ssp
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	"golang.org/x/crypto/acme/autocert"
+
+	sqrl "github.com/RaniSputnik/sqrl-go"
+	"github.com/RaniSputnik/sqrl-go/identity"
+)
+
+const (
+	redisKeyPrefixTransaction  = "sqrl:tx:"
+	redisKeyPrefixNextToFirst  = "sqrl:tx:next:"
+	redisKeyPrefixToken        = "sqrl:token:"
+	redisKeyPrefixUser         = "sqrl:user:"
+	redisKeyPrefixUserByIdk    = "sqrl:user:idk:"
+	redisKeyPrefixCache        = "sqrl:cache:"
+	redisKeyPrefixIdentityLock = "sqrl:identity-lock:"
+)
+
+// redisStore is a Store backed by Redis, letting a SQRL SP share
+// transaction, token and user state across a pool of processes
+// without a dedicated database server. Transactions and tokens carry
+// a TTL matching the Nutter.Expiry they were issued under; users are
+// kept indefinitely.
+type redisStore struct {
+	client redis.Cmdable
+	ttl    time.Duration
+}
+
+// NewRedisStore creates a Store backed by the given Redis client.
+// ttl should match the Nutter.Expiry used to issue nuts, since a
+// transaction or token can never be looked up again once its nut has
+// expired.
+func NewRedisStore(client redis.Cmdable, ttl time.Duration) Store {
+	return &redisStore{client: client, ttl: ttl}
+}
+
+func (s *redisStore) GetFirstTransaction(ctx context.Context, nut sqrl.Nut) (*Transaction, error) {
+	firstID, err := s.client.Get(ctx, redisKeyPrefixNextToFirst+string(nut)).Result()
+	if err == redis.Nil {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	payload, err := s.client.Get(ctx, redisKeyPrefixTransaction+firstID).Result()
+	if err == redis.Nil {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	return UnmarshalTransaction([]byte(payload))
+}
+
+func (s *redisStore) SaveTransaction(ctx context.Context, t *Transaction) error {
+	firstTransaction, err := s.GetFirstTransaction(ctx, t.Id)
+	if err != nil {
+		return err
+	}
+	firstID := t.Id
+	if firstTransaction != nil {
+		firstID = firstTransaction.Id
+	}
+
+	payload, err := MarshalTransaction(t)
+	if err != nil {
+		return err
+	}
+
+	pipe := s.client.TxPipeline()
+	pipe.Set(ctx, redisKeyPrefixTransaction+string(t.Id), payload, s.ttl)
+	pipe.Set(ctx, redisKeyPrefixNextToFirst+string(t.Next), string(firstID), s.ttl)
+	_, err = pipe.Exec(ctx)
+	return err
+}
+
+func (s *redisStore) SaveIdentSuccess(ctx context.Context, nut sqrl.Nut, token Token) error {
+	payload, err := MarshalToken(token)
+	if err != nil {
+		return err
+	}
+	return s.client.Set(ctx, redisKeyPrefixToken+string(nut), payload, s.ttl).Err()
+}
+
+func (s *redisStore) GetIdentSuccess(ctx context.Context, nut sqrl.Nut) (token Token, err error) {
+	payload, err := s.client.Get(ctx, redisKeyPrefixToken+string(nut)).Result()
+	if err == redis.Nil {
+		return token, nil
+	} else if err != nil {
+		return token, err
+	}
+	return UnmarshalToken([]byte(payload))
+}
+
+func (s *redisStore) CreateUser(ctx context.Context, idk sqrl.Identity) (*User, error) {
+	newUser := &User{
+		Id:  uuid(),
+		Idk: idk,
+	}
+	payload, err := MarshalUser(newUser)
+	if err != nil {
+		return nil, err
+	}
+
+	// The idk index is claimed with SetNX before the user record is
+	// ever written, so a lost race never leaves an orphaned user
+	// record behind with nothing pointing to it.
+	took, err := s.client.SetNX(ctx, redisKeyPrefixUserByIdk+string(idk), newUser.Id, 0).Result()
+	if err != nil {
+		return nil, err
+	}
+	if !took {
+		return nil, fmt.Errorf("ssp: user already exists for identity")
+	}
+	if err := s.client.Set(ctx, redisKeyPrefixUser+newUser.Id, payload, 0).Err(); err != nil {
+		// The user write failed after the idk index was claimed; undo
+		// the claim so the identity isn't left permanently locked out.
+		s.client.Del(ctx, redisKeyPrefixUserByIdk+string(idk))
+		return nil, err
+	}
+	return newUser, nil
+}
+
+// putUserScript atomically enforces idk uniqueness across both keys
+// PutUser writes, so concurrent Apply calls racing on the same idk
+// can't both succeed: it only claims or confirms the idk index and
+// writes the user record if no other id already owns that idk.
+var putUserScript = redis.NewScript(`
+	local idkKey = KEYS[1]
+	local userKey = KEYS[2]
+	local id = ARGV[1]
+	local payload = ARGV[2]
+
+	local existing = redis.call('GET', idkKey)
+	if existing and existing ~= id then
+		return 0
+	end
+
+	redis.call('SET', userKey, payload)
+	redis.call('SET', idkKey, id)
+	return 1
+`)
+
+// PutUser persists user verbatim, including its id, rather than
+// minting a new one. It implements UserReplicator, so a
+// ReplicatingStore can apply a CreateUser mutation received from a
+// peer without creating a second user for the same identity.
+//
+// If another node has already replicated a different user for the
+// same idk, that earlier write wins and this one is silently
+// dropped. putUserScript makes the check-then-write atomic by running
+// entirely inside Redis, so two concurrent Apply calls racing on the
+// same idk can't both succeed.
+func (s *redisStore) PutUser(ctx context.Context, user *User) error {
+	payload, err := MarshalUser(user)
+	if err != nil {
+		return err
+	}
+	return putUserScript.Run(ctx, s.client, []string{
+		redisKeyPrefixUserByIdk + string(user.Idk),
+		redisKeyPrefixUser + user.Id,
+	}, user.Id, payload).Err()
+}
+
+func (s *redisStore) GetUserByIdentity(ctx context.Context, idk sqrl.Identity) (*User, error) {
+	userID, err := s.client.Get(ctx, redisKeyPrefixUserByIdk+string(idk)).Result()
+	if err == redis.Nil {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	payload, err := s.client.Get(ctx, redisKeyPrefixUser+userID).Result()
+	if err == redis.Nil {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	return UnmarshalUser([]byte(payload))
+}
+
+// Get, Put and Delete implement CertCache (and so autocert.Cache)
+// over a dedicated key prefix, letting ssp/httpsrv persist Let's
+// Encrypt certificates in the same Redis instance as a redisStore's
+// other state.
+
+func (s *redisStore) Get(ctx context.Context, key string) ([]byte, error) {
+	data, err := s.client.Get(ctx, redisKeyPrefixCache+key).Bytes()
+	if err == redis.Nil {
+		return nil, autocert.ErrCacheMiss
+	}
+	return data, err
+}
+
+func (s *redisStore) Put(ctx context.Context, key string, data []byte) error {
+	return s.client.Set(ctx, redisKeyPrefixCache+key, data, 0).Err()
+}
+
+func (s *redisStore) Delete(ctx context.Context, key string) error {
+	return s.client.Del(ctx, redisKeyPrefixCache+key).Err()
+}
+
+// SaveIdentityLock persists sealed as userID's rescue-code-sealed
+// Identity Unlock Key, replacing any lock previously saved for that
+// user, e.g. after identity.SealedIUK.Rekey.
+func (s *redisStore) SaveIdentityLock(ctx context.Context, userID string, sealed *identity.SealedIUK) error {
+	payload, err := json.Marshal(sealed)
+	if err != nil {
+		return err
+	}
+	return s.client.Set(ctx, redisKeyPrefixIdentityLock+userID, payload, 0).Err()
+}
+
+// GetIdentityLock returns the rescue-code-sealed Identity Unlock Key
+// previously saved for userID, or nil if that user has none.
+func (s *redisStore) GetIdentityLock(ctx context.Context, userID string) (*identity.SealedIUK, error) {
+	payload, err := s.client.Get(ctx, redisKeyPrefixIdentityLock+userID).Result()
+	if err == redis.Nil {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var sealed identity.SealedIUK
+	if err := json.Unmarshal([]byte(payload), &sealed); err != nil {
+		return nil, err
+	}
+	return &sealed, nil
+}
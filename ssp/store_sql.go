@@ -0,0 +1,339 @@
+package ssp
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/acme/autocert"
+
+	sqrl "github.com/RaniSputnik/sqrl-go"
+	"github.com/RaniSputnik/sqrl-go/identity"
+)
+
+// CertCache is implemented by Store backends that can also persist
+// arbitrary key/value blobs, letting ssp/httpsrv reuse the same
+// database or Redis instance backing transactions, tokens and users
+// as the cache for autocert's Let's Encrypt certificates. Its method
+// set matches golang.org/x/crypto/acme/autocert.Cache exactly, so any
+// CertCache can be used as one directly.
+type CertCache interface {
+	Get(ctx context.Context, key string) ([]byte, error)
+	Put(ctx context.Context, key string, data []byte) error
+	Delete(ctx context.Context, key string) error
+}
+
+// IdentityLockStore is implemented by Store backends that can persist
+// a user's rescue-code-sealed Identity Unlock Key, as produced by the
+// sqrl/identity package at account creation.
+type IdentityLockStore interface {
+	SaveIdentityLock(ctx context.Context, userID string, sealed *identity.SealedIUK) error
+	GetIdentityLock(ctx context.Context, userID string) (*identity.SealedIUK, error)
+}
+
+// UserReplicator is implemented by Store backends that can persist a
+// User record verbatim, including its id, as needed to apply a
+// replicated CreateUser mutation without minting a second id for the
+// same identity. See ReplicatingStore and Apply.
+type UserReplicator interface {
+	PutUser(ctx context.Context, user *User) error
+}
+
+// sqlStore is a Store backed by database/sql, usable with any driver
+// that speaks either Postgres or SQLite (the two dialects this module
+// knows how to migrate and query). It lets a SQRL SP survive restarts
+// and share state across a pool of processes talking to the same
+// database.
+type sqlStore struct {
+	db      *sql.DB
+	dialect Dialect
+	ttl     time.Duration
+}
+
+// NewSQLStore creates a Store backed by db. db must already be
+// connected using a driver appropriate for dialect, for example
+// github.com/lib/pq for DialectPostgres or github.com/mattn/go-sqlite3
+// for DialectSQLite. Migrate should be run once, typically at start
+// up, before the store is used.
+//
+// ttl is the age past which expireBefore deletes transactions and
+// tokens, and should match the Nutter.Expiry used to issue nuts. The
+// store never calls expireBefore itself, so expired rows are not
+// removed automatically and lookups return rows of any age. Users are
+// kept indefinitely.
+func NewSQLStore(db *sql.DB, dialect Dialect, ttl time.Duration) Store {
+	return &sqlStore{db: db, dialect: dialect, ttl: ttl}
+}
+
+// Migrate creates or upgrades the schema a sqlStore expects. It is
+// safe to call on every start up; each statement is idempotent.
+func Migrate(ctx context.Context, db *sql.DB, dialect Dialect) error {
+	for _, stmt := range migrationsFor(dialect) {
+		if _, err := db.ExecContext(ctx, stmt); err != nil {
+			return fmt.Errorf("ssp: migration failed: %w", err)
+		}
+	}
+	return nil
+}
+
+// rebind rewrites a query written with ? placeholders into the form
+// the store's dialect expects, e.g. $1, $2 for Postgres.
+func (s *sqlStore) rebind(query string) string {
+	if s.dialect != DialectPostgres {
+		return query
+	}
+	var b strings.Builder
+	n := 0
+	for _, r := range query {
+		if r == '?' {
+			n++
+			b.WriteByte('$')
+			b.WriteString(strconv.Itoa(n))
+			continue
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+func (s *sqlStore) GetFirstTransaction(ctx context.Context, nut sqrl.Nut) (*Transaction, error) {
+	row := s.db.QueryRowContext(ctx, s.rebind(
+		`SELECT first.payload FROM transactions t
+		 JOIN transactions first ON first.id = t.first_id
+		 WHERE t.next = ?`), string(nut))
+
+	var payload []byte
+	if err := row.Scan(&payload); err == sql.ErrNoRows {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	firstTransaction, err := UnmarshalTransaction(payload)
+	if err != nil {
+		return nil, err
+	}
+	return firstTransaction, nil
+}
+
+func (s *sqlStore) SaveTransaction(ctx context.Context, t *Transaction) error {
+	firstTransaction, err := s.GetFirstTransaction(ctx, t.Id)
+	if err != nil {
+		return err
+	}
+	firstID := t.Id
+	if firstTransaction != nil {
+		firstID = firstTransaction.Id
+	}
+
+	payload, err := MarshalTransaction(t)
+	if err != nil {
+		return err
+	}
+
+	_, err = s.db.ExecContext(ctx, s.rebind(s.upsert(
+		"transactions", []string{"id"},
+		[]string{"next", "first_id", "payload", "created_at"})),
+		string(t.Id), string(t.Next), string(firstID), payload, time.Now().UTC())
+	return err
+}
+
+func (s *sqlStore) SaveIdentSuccess(ctx context.Context, nut sqrl.Nut, token Token) error {
+	payload, err := MarshalToken(token)
+	if err != nil {
+		return err
+	}
+	_, err = s.db.ExecContext(ctx, s.rebind(s.upsert(
+		"tokens", []string{"nut"}, []string{"payload", "created_at"})),
+		string(nut), payload, time.Now().UTC())
+	return err
+}
+
+func (s *sqlStore) GetIdentSuccess(ctx context.Context, nut sqrl.Nut) (token Token, err error) {
+	row := s.db.QueryRowContext(ctx,
+		s.rebind(`SELECT payload FROM tokens WHERE nut = ?`), string(nut))
+
+	var payload []byte
+	if err := row.Scan(&payload); err == sql.ErrNoRows {
+		return token, nil
+	} else if err != nil {
+		return token, err
+	}
+	token, err = UnmarshalToken(payload)
+	return token, err
+}
+
+func (s *sqlStore) CreateUser(ctx context.Context, idk sqrl.Identity) (*User, error) {
+	newUser := &User{
+		Id:  uuid(),
+		Idk: idk,
+	}
+	payload, err := MarshalUser(newUser)
+	if err != nil {
+		return nil, err
+	}
+
+	// The WHERE NOT EXISTS guard enforces idk uniqueness within the
+	// insert itself, and ON CONFLICT DO NOTHING turns a concurrent
+	// insert that slips past it into zero rows affected, so the
+	// failure mode is the same friendly error on every dialect rather
+	// than a driver-specific unique-constraint violation surfacing
+	// from users_idk_idx.
+	result, err := s.db.ExecContext(ctx, s.rebind(`
+		INSERT INTO users (id, idk, payload, created_at)
+		SELECT ?, ?, ?, ?
+		WHERE NOT EXISTS (SELECT 1 FROM users WHERE idk = ?)
+		ON CONFLICT DO NOTHING
+	`), newUser.Id, string(idk), payload, time.Now().UTC(), string(idk))
+	if err != nil {
+		return nil, err
+	}
+	if n, err := result.RowsAffected(); err != nil {
+		return nil, err
+	} else if n == 0 {
+		return nil, fmt.Errorf("ssp: user already exists for identity")
+	}
+	return newUser, nil
+}
+
+// PutUser persists user verbatim, including its id, rather than
+// minting a new one. It implements UserReplicator, so a
+// ReplicatingStore can apply a CreateUser mutation received from a
+// peer without creating a second user for the same identity.
+//
+// Unlike CreateUser, PutUser must tolerate being handed a user for an
+// idk some other node has already replicated under a different id:
+// that earlier write wins and this one is silently dropped. The
+// INSERT...SELECT...WHERE NOT EXISTS guard and the conditional
+// ON CONFLICT...WHERE clause below do the check and the write in a
+// single statement. Two concurrent Apply calls racing on the same idk
+// can't both succeed, since users_idk_idx rejects the second; on
+// Postgres that second call then returns a unique-constraint error
+// rather than being dropped silently.
+func (s *sqlStore) PutUser(ctx context.Context, user *User) error {
+	payload, err := MarshalUser(user)
+	if err != nil {
+		return err
+	}
+	_, err = s.db.ExecContext(ctx, s.rebind(`
+		INSERT INTO users (id, idk, payload, created_at)
+		SELECT ?, ?, ?, ?
+		WHERE NOT EXISTS (SELECT 1 FROM users WHERE idk = ? AND id != ?)
+		ON CONFLICT (id) DO UPDATE SET
+			idk = excluded.idk, payload = excluded.payload, created_at = excluded.created_at
+		WHERE NOT EXISTS (SELECT 1 FROM users u2 WHERE u2.idk = excluded.idk AND u2.id != excluded.id)
+	`), user.Id, string(user.Idk), payload, time.Now().UTC(), string(user.Idk), user.Id)
+	return err
+}
+
+func (s *sqlStore) GetUserByIdentity(ctx context.Context, idk sqrl.Identity) (*User, error) {
+	row := s.db.QueryRowContext(ctx,
+		s.rebind(`SELECT payload FROM users WHERE idk = ?`), string(idk))
+
+	var payload []byte
+	if err := row.Scan(&payload); err == sql.ErrNoRows {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	return UnmarshalUser(payload)
+}
+
+// Get, Put and Delete implement CertCache (and so autocert.Cache)
+// over the store's cache table, letting ssp/httpsrv persist Let's
+// Encrypt certificates alongside a sqlStore's other state.
+
+func (s *sqlStore) Get(ctx context.Context, key string) ([]byte, error) {
+	row := s.db.QueryRowContext(ctx, s.rebind(`SELECT data FROM cache WHERE key = ?`), key)
+	var data []byte
+	if err := row.Scan(&data); err == sql.ErrNoRows {
+		return nil, autocert.ErrCacheMiss
+	} else if err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+func (s *sqlStore) Put(ctx context.Context, key string, data []byte) error {
+	_, err := s.db.ExecContext(ctx,
+		s.rebind(s.upsert("cache", []string{"key"}, []string{"data"})), key, data)
+	return err
+}
+
+func (s *sqlStore) Delete(ctx context.Context, key string) error {
+	_, err := s.db.ExecContext(ctx, s.rebind(`DELETE FROM cache WHERE key = ?`), key)
+	return err
+}
+
+// SaveIdentityLock persists sealed as userID's rescue-code-sealed
+// Identity Unlock Key, replacing any lock previously saved for that
+// user, e.g. after identity.SealedIUK.Rekey.
+func (s *sqlStore) SaveIdentityLock(ctx context.Context, userID string, sealed *identity.SealedIUK) error {
+	_, err := s.db.ExecContext(ctx, s.rebind(s.upsert("identity_locks", []string{"user_id"}, []string{
+		"salt", "argon2_time", "argon2_memory_kib", "argon2_threads", "argon2_key_len", "nonce", "ciphertext",
+	})), userID, sealed.Salt, sealed.Params.Time, sealed.Params.MemoryKiB, sealed.Params.Threads, sealed.Params.KeyLen,
+		sealed.Nonce, sealed.Ciphertext)
+	return err
+}
+
+// GetIdentityLock returns the rescue-code-sealed Identity Unlock Key
+// previously saved for userID, or nil if that user has none.
+func (s *sqlStore) GetIdentityLock(ctx context.Context, userID string) (*identity.SealedIUK, error) {
+	row := s.db.QueryRowContext(ctx, s.rebind(
+		`SELECT salt, argon2_time, argon2_memory_kib, argon2_threads, argon2_key_len, nonce, ciphertext
+		 FROM identity_locks WHERE user_id = ?`), userID)
+
+	var sealed identity.SealedIUK
+	err := row.Scan(&sealed.Salt, &sealed.Params.Time, &sealed.Params.MemoryKiB,
+		&sealed.Params.Threads, &sealed.Params.KeyLen, &sealed.Nonce, &sealed.Ciphertext)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	return &sealed, nil
+}
+
+// expireBefore removes transactions and tokens that were written
+// more than the store's ttl before now, mirroring the Nutter.Expiry
+// they were issued under. It is unexported and nothing in this
+// package calls it.
+func (s *sqlStore) expireBefore(ctx context.Context, now time.Time) error {
+	cutoff := now.Add(-s.ttl)
+	if _, err := s.db.ExecContext(ctx,
+		s.rebind(`DELETE FROM transactions WHERE created_at < ?`), cutoff); err != nil {
+		return err
+	}
+	_, err := s.db.ExecContext(ctx,
+		s.rebind(`DELETE FROM tokens WHERE created_at < ?`), cutoff)
+	return err
+}
+
+// upsert builds an "INSERT ... ON CONFLICT ... DO UPDATE" statement for the
+// store's dialect. keyCols identify the conflict target and cols are
+// the remaining columns to write.
+func (s *sqlStore) upsert(table string, keyCols, cols []string) string {
+	allCols := append(append([]string{}, keyCols...), cols...)
+	placeholders := strings.TrimRight(strings.Repeat("?,", len(allCols)), ",")
+
+	set := make([]string, len(cols))
+	for i, c := range cols {
+		set[i] = fmt.Sprintf("%s = excluded.%s", c, c)
+	}
+
+	if s.dialect == DialectSQLite {
+		return fmt.Sprintf(
+			`INSERT INTO %s (%s) VALUES (%s)
+			 ON CONFLICT(%s) DO UPDATE SET %s`,
+			table, strings.Join(allCols, ", "), placeholders,
+			strings.Join(keyCols, ", "), strings.Join(set, ", "))
+	}
+	return fmt.Sprintf(
+		`INSERT INTO %s (%s) VALUES (%s)
+		 ON CONFLICT (%s) DO UPDATE SET %s`,
+		table, strings.Join(allCols, ", "), placeholders,
+		strings.Join(keyCols, ", "), strings.Join(set, ", "))
+}
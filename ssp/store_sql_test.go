@@ -0,0 +1,27 @@
+package ssp
+
+import (
+	"context"
+	"database/sql"
+	"testing"
+	"time"
+
+	_ "modernc.org/sqlite"
+)
+
+func newTestSQLStore(t *testing.T) Store {
+	db, err := sql.Open("sqlite", ":memory:")
+	if err != nil {
+		t.Fatalf("sql.Open: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	if err := Migrate(context.Background(), db, DialectSQLite); err != nil {
+		t.Fatalf("Migrate: %v", err)
+	}
+	return NewSQLStore(db, DialectSQLite, 5*time.Minute)
+}
+
+func TestSQLStore(t *testing.T) {
+	storeContractTest(t, newTestSQLStore)
+}